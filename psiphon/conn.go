@@ -21,6 +21,7 @@ package psiphon
 
 import (
 	"bufio"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -40,6 +41,20 @@ type DialConfig struct {
 	// or IP address and must include a port number.
 	UpstreamHttpProxyAddress string
 
+	// UpstreamSocksProxyAddress specifies a SOCKS5 proxy to connect through
+	// (RFC 1928). The address may be a hostname or IP address and must
+	// include a port number. UpstreamHttpProxyAddress and
+	// UpstreamSocksProxyAddress are mutually exclusive.
+	UpstreamSocksProxyAddress string
+
+	// UpstreamProxyUsername and UpstreamProxyPassword are optional
+	// credentials used to authenticate with the upstream proxy. For
+	// UpstreamHttpProxyAddress, these are sent as a Proxy-Authorization:
+	// Basic header. For UpstreamSocksProxyAddress, these are sent using
+	// the SOCKS5 username/password authentication method (RFC 1929).
+	UpstreamProxyUsername string
+	UpstreamProxyPassword string
+
 	ConnectTimeout time.Duration
 	ReadTimeout    time.Duration
 	WriteTimeout   time.Duration
@@ -60,6 +75,12 @@ type DialConfig struct {
 	// DNS server.
 	BindToDeviceProvider  DeviceBinder
 	BindToDeviceDnsServer string
+
+	// SecureResolver, when set, is used in place of BindToDeviceDnsServer
+	// to resolve hostnames via DoH, DoT, or DNSCrypt instead of plaintext
+	// UDP, closing a DNS-based side channel that can otherwise leak
+	// browsing activity or be poisoned even when BindToDevice is used.
+	SecureResolver *SecureResolver
 }
 
 // DeviceBinder defines the interface to the external BindToDevice provider
@@ -153,19 +174,51 @@ func Relay(localConn, remoteConn net.Conn) {
 	copyWaitGroup.Wait()
 }
 
+// ProxyAuthorization provides a complete Proxy-Authorization header line,
+// including its trailing "\r\n", to present to an upstream HTTP proxy;
+// HttpProxyConnect inserts it verbatim. Implementations may return
+// ("", nil) to send no Proxy-Authorization header at all.
+type ProxyAuthorization interface {
+	AuthorizationHeader() (string, error)
+}
+
+// basicProxyAuthorization implements ProxyAuthorization using HTTP Basic
+// authentication (RFC 7617). Additional schemes (NTLM, Digest) can be
+// added as further implementations of ProxyAuthorization.
+type basicProxyAuthorization struct {
+	username string
+	password string
+}
+
+func (auth *basicProxyAuthorization) AuthorizationHeader() (string, error) {
+	credentials := base64.StdEncoding.EncodeToString(
+		[]byte(auth.username + ":" + auth.password))
+	return fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", credentials), nil
+}
+
 // HttpProxyConnect establishes a HTTP CONNECT tunnel to addr through
 // an established network connection to an HTTP proxy. It is assumed that
 // no payload bytes have been sent through the connection to the proxy.
-func HttpProxyConnect(rawConn net.Conn, addr string) (err error) {
+// When auth is not nil, its Proxy-Authorization header is included in
+// the CONNECT request.
+func HttpProxyConnect(rawConn net.Conn, addr string, auth ProxyAuthorization) (err error) {
 	hostname, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return ContextError(err)
 	}
 
+	authorizationHeader := ""
+	if auth != nil {
+		authorizationHeader, err = auth.AuthorizationHeader()
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+
 	// TODO: use the proxy request/response code from net/http/transport.go?
 	connectRequest := fmt.Sprintf(
-		"CONNECT %s HTTP/1.1\r\nHost: %s\r\nConnection: Keep-Alive\r\n\r\n",
-		addr, hostname)
+		"CONNECT %s HTTP/1.1\r\nHost: %s\r\nConnection: Keep-Alive\r\n%s\r\n",
+		addr, hostname, authorizationHeader)
 	_, err = rawConn.Write([]byte(connectRequest))
 	if err != nil {
 		return ContextError(err)
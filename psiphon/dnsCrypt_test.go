@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// buildTestDNSCryptCertificateTXT constructs a wire-format DNS TXT
+// response carrying a DNSCrypt v2 certificate with the given resolver
+// public key, client magic, and expiry, per the field layout documented
+// on dnsCryptCertificateFixedFieldsLength.
+func buildTestDNSCryptCertificateTXT(t *testing.T, resolverPublicKey [32]byte, clientMagic [8]byte, notAfter time.Time) []byte {
+	t.Helper()
+
+	cert := make([]byte, dnsCryptCertificateFixedFieldsLength)
+	copy(cert[0:4], "DNSC")
+	// es-version, protocol-minor-version, signature: left zeroed, not
+	// relevant to parseDNSCryptCertificateTXT, which does not verify them.
+	copy(cert[72:104], resolverPublicKey[:])
+	copy(cert[104:112], clientMagic[:])
+	// serial: left zeroed
+	tsEnd := uint32(notAfter.Unix())
+	cert[120] = byte(tsEnd >> 24)
+	cert[121] = byte(tsEnd >> 16)
+	cert[122] = byte(tsEnd >> 8)
+	cert[123] = byte(tsEnd)
+
+	txtRecord := append([]byte{byte(len(cert))}, cert...)
+
+	header := []byte{0xab, 0xcd, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}
+	question := []byte{0x08, 'p', 'r', 'o', 'v', 'i', 'd', 'e', 'r', 0x00, 0x00, 0x10, 0x00, 0x01}
+	answer := []byte{0xc0, 0x0c, 0x00, 0x10, 0x00, 0x01, 0, 0, 0, 60}
+	rdlength := []byte{byte(len(txtRecord) >> 8), byte(len(txtRecord))}
+
+	response := append([]byte{}, header...)
+	response = append(response, question...)
+	response = append(response, answer...)
+	response = append(response, rdlength...)
+	response = append(response, txtRecord...)
+
+	return response
+}
+
+func TestParseDNSCryptCertificateTXT(t *testing.T) {
+	var resolverPublicKey [32]byte
+	for i := range resolverPublicKey {
+		resolverPublicKey[i] = byte(i + 1)
+	}
+	var clientMagic [8]byte
+	copy(clientMagic[:], "ABCDEFGH")
+	notAfter := time.Unix(1700000000, 0)
+
+	response := buildTestDNSCryptCertificateTXT(t, resolverPublicKey, clientMagic, notAfter)
+
+	cert, err := parseDNSCryptCertificateTXT(response)
+	if err != nil {
+		t.Fatalf("parseDNSCryptCertificateTXT failed: %s", err)
+	}
+	if cert.ResolverPublicKey != resolverPublicKey {
+		t.Fatalf("expected resolver public key %v, got %v", resolverPublicKey, cert.ResolverPublicKey)
+	}
+	if cert.ClientMagic != clientMagic {
+		t.Fatalf("expected client magic %v, got %v", clientMagic, cert.ClientMagic)
+	}
+	if !cert.NotAfter.Equal(notAfter) {
+		t.Fatalf("expected NotAfter %v, got %v", notAfter, cert.NotAfter)
+	}
+}
+
+func TestDNSCryptQueryResponseRoundTrip(t *testing.T) {
+
+	resolverPublicKey, resolverPrivateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+
+	var clientMagic [8]byte
+	copy(clientMagic[:], "ABCDEFGH")
+	cert := &dnsCryptCertificate{
+		ClientMagic:       clientMagic,
+		ResolverPublicKey: *resolverPublicKey,
+		NotAfter:          time.Now().Add(time.Hour),
+	}
+
+	plaintextQuery := []byte("this is a DNS wire-format query")
+
+	encryptedQuery, clientNonce, clientEphemeralPrivateKey, err := encryptDNSCryptQuery(plaintextQuery, cert)
+	if err != nil {
+		t.Fatalf("encryptDNSCryptQuery failed: %s", err)
+	}
+
+	if !bytes.Equal(encryptedQuery[0:8], clientMagic[:]) {
+		t.Fatalf("expected client query to be prefixed with the certificate's client magic")
+	}
+
+	// Simulate the resolver: open the query with its private key, then
+	// seal a response under a server-chosen nonce.
+	queryClientPublicKey := encryptedQuery[8:40]
+	var queryClientPublicKeyArray [32]byte
+	copy(queryClientPublicKeyArray[:], queryClientPublicKey)
+
+	queryClientNonce := encryptedQuery[40:52]
+	var sealNonce [24]byte
+	copy(sealNonce[:12], queryClientNonce)
+
+	decryptedQuery, ok := box.Open(nil, encryptedQuery[52:], &sealNonce, &queryClientPublicKeyArray, resolverPrivateKey)
+	if !ok {
+		t.Fatalf("resolver failed to decrypt client query")
+	}
+	if !bytes.Equal(decryptedQuery, plaintextQuery) {
+		t.Fatalf("decrypted query does not match plaintext query")
+	}
+
+	plaintextResponse := []byte("this is a DNS wire-format response")
+
+	var responseNonce [24]byte
+	copy(responseNonce[:12], queryClientNonce)
+	copy(responseNonce[12:], "serverhalf12")
+
+	sealedResponse := box.Seal(nil, plaintextResponse, &responseNonce, &queryClientPublicKeyArray, resolverPrivateKey)
+
+	response := append([]byte{}, []byte("r6fnvWj8")...) // resolver-magic
+	response = append(response, responseNonce[:]...)
+	response = append(response, sealedResponse...)
+
+	answer, err := decryptDNSCryptResponse(response, cert, clientNonce, clientEphemeralPrivateKey)
+	if err != nil {
+		t.Fatalf("decryptDNSCryptResponse failed: %s", err)
+	}
+	if !bytes.Equal(answer, plaintextResponse) {
+		t.Fatalf("expected decrypted response %q, got %q", plaintextResponse, answer)
+	}
+}
+
@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// DNS query/record types used by buildDNSQuery and the answer parsers.
+const (
+	dnsRecordTypeA = 0x0001
+)
+
+// buildDNSQuery encodes a minimal DNS wire-format query (RFC 1035) for
+// the qtype record of hostname, with a fixed query ID (0xabcd) and
+// recursion desired.
+func buildDNSQuery(hostname string, qtype uint16) ([]byte, error) {
+
+	var query bytes.Buffer
+	query.Write([]byte{0xab, 0xcd}) // query ID
+	query.Write([]byte{0x01, 0x00}) // flags: recursion desired
+	query.Write([]byte{0x00, 0x01}) // QDCOUNT = 1
+	query.Write([]byte{0x00, 0x00}) // ANCOUNT = 0
+	query.Write([]byte{0x00, 0x00}) // NSCOUNT = 0
+	query.Write([]byte{0x00, 0x00}) // ARCOUNT = 0
+
+	for _, label := range strings.Split(hostname, ".") {
+		if len(label) == 0 {
+			continue
+		}
+		if len(label) > 63 {
+			return nil, ContextError(errors.New("DNS label too long"))
+		}
+		query.WriteByte(byte(len(label)))
+		query.WriteString(label)
+	}
+	query.WriteByte(0x00)
+
+	query.Write([]byte{byte(qtype >> 8), byte(qtype)}) // QTYPE
+	query.Write([]byte{0x00, 0x01})                    // QCLASS = IN
+
+	return query.Bytes(), nil
+}
+
+// parseDNSAnswer extracts the first A record address from a DNS
+// wire-format response.
+func parseDNSAnswer(response []byte) (string, error) {
+
+	if len(response) < 12 {
+		return "", ContextError(errors.New("DNS response too short"))
+	}
+
+	questionCount := int(binary.BigEndian.Uint16(response[4:6]))
+	answerCount := int(binary.BigEndian.Uint16(response[6:8]))
+	if answerCount == 0 {
+		return "", ContextError(errors.New("DNS response has no answers"))
+	}
+
+	offset := 12
+	for i := 0; i < questionCount; i++ {
+		var err error
+		offset, err = skipDNSName(response, offset)
+		if err != nil {
+			return "", ContextError(err)
+		}
+		offset += 4 // QTYPE + QCLASS
+	}
+
+	for i := 0; i < answerCount; i++ {
+		var err error
+		offset, err = skipDNSName(response, offset)
+		if err != nil {
+			return "", ContextError(err)
+		}
+		if offset+10 > len(response) {
+			return "", ContextError(errors.New("truncated DNS answer"))
+		}
+		recordType := binary.BigEndian.Uint16(response[offset : offset+2])
+		recordLength := int(binary.BigEndian.Uint16(response[offset+8 : offset+10]))
+		offset += 10
+		if offset+recordLength > len(response) {
+			return "", ContextError(errors.New("truncated DNS answer data"))
+		}
+		if recordType == dnsRecordTypeA && recordLength == net.IPv4len {
+			ip := net.IP(response[offset : offset+recordLength])
+			return ip.String(), nil
+		}
+		offset += recordLength
+	}
+
+	return "", ContextError(errors.New("no A record found in DNS response"))
+}
+
+// extractFirstRecordData scans a DNS wire-format response for the first
+// resource record of the given type and returns its RDATA.
+func extractFirstRecordData(response []byte, recordType uint16) ([]byte, error) {
+
+	if len(response) < 12 {
+		return nil, ContextError(errors.New("DNS response too short"))
+	}
+
+	questionCount := int(binary.BigEndian.Uint16(response[4:6]))
+	answerCount := int(binary.BigEndian.Uint16(response[6:8]))
+
+	offset := 12
+	for i := 0; i < questionCount; i++ {
+		var err error
+		offset, err = skipDNSName(response, offset)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		offset += 4
+	}
+
+	for i := 0; i < answerCount; i++ {
+		var err error
+		offset, err = skipDNSName(response, offset)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		if offset+10 > len(response) {
+			return nil, ContextError(errors.New("truncated DNS answer"))
+		}
+		thisType := binary.BigEndian.Uint16(response[offset : offset+2])
+		recordLength := int(binary.BigEndian.Uint16(response[offset+8 : offset+10]))
+		offset += 10
+		if offset+recordLength > len(response) {
+			return nil, ContextError(errors.New("truncated DNS answer data"))
+		}
+		if thisType == recordType {
+			return response[offset : offset+recordLength], nil
+		}
+		offset += recordLength
+	}
+
+	return nil, ContextError(errors.New("no matching record found in DNS response"))
+}
+
+// skipDNSName advances past a DNS name, including compressed names
+// (RFC 1035 section 4.1.4), returning the offset immediately following.
+func skipDNSName(message []byte, offset int) (int, error) {
+	for {
+		if offset >= len(message) {
+			return 0, ContextError(errors.New("invalid DNS name"))
+		}
+		length := int(message[offset])
+		if length == 0 {
+			return offset + 1, nil
+		}
+		if length&0xc0 == 0xc0 {
+			// Compressed name pointer: 2 bytes, no further labels here.
+			return offset + 2, nil
+		}
+		offset += 1 + length
+	}
+}
+
+// readLengthPrefixedDNSAnswer reads a 2-byte length-prefixed DNS
+// response, as used by DNS-over-TCP and DNS-over-TLS (RFC 1035 section
+// 4.2.2), and returns the resolved A record address.
+func readLengthPrefixedDNSAnswer(conn net.Conn) (string, error) {
+
+	lengthPrefix := make([]byte, 2)
+	_, err := readFull(conn, lengthPrefix)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	length := int(binary.BigEndian.Uint16(lengthPrefix))
+	answer := make([]byte, length)
+	_, err = readFull(conn, answer)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	return parseDNSAnswer(answer)
+}
+
+// exchangeDNSMessage sends a DNS wire-format query for hostname over
+// conn and parses the A record from the response, as used by the
+// plaintext UDP fallback resolver.
+func exchangeDNSMessage(conn net.Conn, hostname string) (string, error) {
+
+	query, err := buildDNSQuery(hostname, dnsRecordTypeA)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	_, err = conn.Write(query)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	response := make([]byte, 512)
+	n, err := conn.Read(response)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	return parseDNSAnswer(response[:n])
+}
+
+func readFull(conn net.Conn, buffer []byte) (int, error) {
+	total := 0
+	for total < len(buffer) {
+		n, err := conn.Read(buffer[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
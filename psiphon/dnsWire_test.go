@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// buildDNSAResponse constructs a minimal wire-format DNS response with a
+// single A answer, echoing the question from query, for use in tests.
+func buildDNSAResponse(t *testing.T, query []byte, ip [4]byte) []byte {
+	t.Helper()
+
+	response := append([]byte{}, query...)
+	binary.BigEndian.PutUint16(response[6:8], 1) // ANCOUNT = 1
+
+	response = append(response, 0xc0, 0x0c) // name: pointer to question
+	response = append(response, 0x00, 0x01) // TYPE = A
+	response = append(response, 0x00, 0x01) // CLASS = IN
+	response = append(response, 0, 0, 0, 60) // TTL
+	response = append(response, 0x00, 0x04) // RDLENGTH = 4
+	response = append(response, ip[:]...)
+
+	return response
+}
+
+func TestBuildAndParseDNSQueryA(t *testing.T) {
+	query, err := buildDNSQuery("example.com", dnsRecordTypeA)
+	if err != nil {
+		t.Fatalf("buildDNSQuery failed: %s", err)
+	}
+
+	qtype := uint16(query[len(query)-4])<<8 | uint16(query[len(query)-3])
+	if qtype != dnsRecordTypeA {
+		t.Fatalf("expected QTYPE A, got %d", qtype)
+	}
+
+	response := buildDNSAResponse(t, query, [4]byte{93, 184, 216, 34})
+
+	address, err := parseDNSAnswer(response)
+	if err != nil {
+		t.Fatalf("parseDNSAnswer failed: %s", err)
+	}
+	if address != "93.184.216.34" {
+		t.Fatalf("expected 93.184.216.34, got %s", address)
+	}
+}
+
+func TestBuildDNSQueryTXTType(t *testing.T) {
+	query, err := buildDNSQuery("2.dnscrypt-cert.example.com", dnsRecordTypeTXT)
+	if err != nil {
+		t.Fatalf("buildDNSQuery failed: %s", err)
+	}
+
+	qtype := uint16(query[len(query)-4])<<8 | uint16(query[len(query)-3])
+	if qtype != dnsRecordTypeTXT {
+		t.Fatalf("expected QTYPE TXT (%d), got %d", dnsRecordTypeTXT, qtype)
+	}
+}
+
+func TestParseDNSAnswerNoAnswers(t *testing.T) {
+	query, err := buildDNSQuery("example.com", dnsRecordTypeA)
+	if err != nil {
+		t.Fatalf("buildDNSQuery failed: %s", err)
+	}
+
+	if _, err := parseDNSAnswer(query); err == nil {
+		t.Fatal("expected error parsing a response with no answers")
+	}
+}
@@ -0,0 +1,439 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Frame types for the multiplex tunnel's framed protocol. Each frame on
+// the wire is: [1 byte type][8 byte connID][4 byte payload length][payload].
+const (
+	muxFrameDialRequest  = 0x01
+	muxFrameDialResponse = 0x02
+	muxFrameData         = 0x03
+	muxFrameCloseRequest = 0x04
+	muxFrameCloseReply   = 0x05
+)
+
+// dialResult is delivered to a pending Dial() call once a DIAL_RSP frame
+// for its connID arrives on the control stream.
+type dialResult struct {
+	err error
+}
+
+// MultiplexTunnel establishes a single, long-lived, authenticated
+// connection (the control stream) to a Psiphon server and multiplexes
+// many logical net.Conns over it, in the manner of the konnectivity gRPC
+// proxy's tunnel: one reader goroutine demultiplexes frames by connID and
+// fans them out to per-connection queues.
+type MultiplexTunnel struct {
+	controlConn net.Conn
+
+	mutex       sync.Mutex
+	nextConnID  int64
+	pendingDial map[int64]chan dialResult
+	conns       map[int64]*muxConn
+	closed      bool
+
+	// writeMutex serializes writes to controlConn, separately from mutex,
+	// which guards pendingDial/conns lookups. readLoop must be able to
+	// look up a connID under mutex while a blocking controlConn.Write
+	// (held only by writeMutex) is stalled under TCP backpressure;
+	// sharing one mutex between the two would let a stalled Write freeze
+	// the demux loop and head-of-line-block every logical conn.
+	writeMutex sync.Mutex
+}
+
+// NewMultiplexTunnel wraps an already-established, authenticated
+// connection to a Psiphon server as a MultiplexTunnel control stream and
+// starts the frame reader goroutine.
+func NewMultiplexTunnel(controlConn net.Conn) *MultiplexTunnel {
+	tunnel := &MultiplexTunnel{
+		controlConn: controlConn,
+		pendingDial: make(map[int64]chan dialResult),
+		conns:       make(map[int64]*muxConn),
+	}
+	go tunnel.readLoop()
+	return tunnel
+}
+
+// Dial opens a new logical connection to address over the tunnel's
+// control stream, blocking until the remote end's DIAL_RSP frame is
+// received, and returns a net.Conn multiplexed over the shared
+// controlConn.
+func (tunnel *MultiplexTunnel) Dial(protocol, address string) (net.Conn, error) {
+
+	tunnel.mutex.Lock()
+	if tunnel.closed {
+		tunnel.mutex.Unlock()
+		return nil, ContextError(errors.New("multiplex tunnel is closed"))
+	}
+	connID := tunnel.nextConnID
+	tunnel.nextConnID++
+	resultChannel := make(chan dialResult, 1)
+	tunnel.pendingDial[connID] = resultChannel
+	conn := newMuxConn(tunnel, connID)
+	tunnel.conns[connID] = conn
+	tunnel.mutex.Unlock()
+
+	payload := []byte(protocol + " " + address)
+	err := tunnel.writeFrame(muxFrameDialRequest, connID, payload)
+	if err != nil {
+		tunnel.mutex.Lock()
+		delete(tunnel.pendingDial, connID)
+		delete(tunnel.conns, connID)
+		tunnel.mutex.Unlock()
+		return nil, ContextError(err)
+	}
+
+	result := <-resultChannel
+	if result.err != nil {
+		tunnel.mutex.Lock()
+		delete(tunnel.conns, connID)
+		tunnel.mutex.Unlock()
+		return nil, ContextError(result.err)
+	}
+
+	return conn, nil
+}
+
+// Dialer returns a Dialer, compatible with http.Transport.Dial and the
+// tunnel relay, that opens logical connections over this
+// MultiplexTunnel instead of dialing a new raw connection per request.
+func (tunnel *MultiplexTunnel) Dialer() Dialer {
+	return func(network, addr string) (net.Conn, error) {
+		return tunnel.Dial(network, addr)
+	}
+}
+
+// Close tears down the control stream, fails all pending dials, and
+// closes all live multiplexed connections. Closing controlConn directly,
+// as CloseAll does for a Conns list that contains it, has the same
+// effect via readLoop's stream error handling.
+func (tunnel *MultiplexTunnel) Close() error {
+	tunnel.mutex.Lock()
+	if tunnel.closed {
+		tunnel.mutex.Unlock()
+		return nil
+	}
+	tunnel.closed = true
+	tunnel.failAllLocked(errors.New("multiplex tunnel closed"))
+	tunnel.mutex.Unlock()
+	return tunnel.controlConn.Close()
+}
+
+// removeConn removes connID from the tunnel's live connection table, if
+// present.
+func (tunnel *MultiplexTunnel) removeConn(connID int64) {
+	tunnel.mutex.Lock()
+	delete(tunnel.conns, connID)
+	tunnel.mutex.Unlock()
+}
+
+// failAllLocked fails all pending dials and closes all live connections.
+// The caller must hold tunnel.mutex.
+func (tunnel *MultiplexTunnel) failAllLocked(err error) {
+	for connID, resultChannel := range tunnel.pendingDial {
+		resultChannel <- dialResult{err: err}
+		delete(tunnel.pendingDial, connID)
+	}
+	for connID, conn := range tunnel.conns {
+		conn.closeWithError(err)
+		delete(tunnel.conns, connID)
+	}
+}
+
+// readLoop is the single reader goroutine that demultiplexes frames
+// arriving on the control stream and delivers them to the matching
+// pending dial or connection. On any stream error, all pending dials
+// are failed and all live connections are closed.
+func (tunnel *MultiplexTunnel) readLoop() {
+	for {
+		frameType, connID, payload, err := tunnel.readFrame()
+		if err != nil {
+			tunnel.mutex.Lock()
+			tunnel.closed = true
+			tunnel.failAllLocked(ContextError(err))
+			tunnel.mutex.Unlock()
+			return
+		}
+
+		switch frameType {
+
+		case muxFrameDialResponse:
+			tunnel.mutex.Lock()
+			resultChannel, ok := tunnel.pendingDial[connID]
+			delete(tunnel.pendingDial, connID)
+			tunnel.mutex.Unlock()
+			if ok {
+				var dialErr error
+				if len(payload) > 0 {
+					dialErr = errors.New(string(payload))
+				}
+				resultChannel <- dialResult{err: dialErr}
+			}
+
+		case muxFrameData:
+			tunnel.mutex.Lock()
+			conn, ok := tunnel.conns[connID]
+			tunnel.mutex.Unlock()
+			if ok {
+				conn.deliver(payload)
+			}
+
+		case muxFrameCloseReply, muxFrameCloseRequest:
+			tunnel.mutex.Lock()
+			conn, ok := tunnel.conns[connID]
+			delete(tunnel.conns, connID)
+			tunnel.mutex.Unlock()
+			if ok {
+				conn.closeWithError(io.EOF)
+			}
+
+		default:
+			NoticeAlert("multiplex tunnel: unknown frame type %d", frameType)
+		}
+	}
+}
+
+func (tunnel *MultiplexTunnel) writeFrame(frameType byte, connID int64, payload []byte) error {
+	header := make([]byte, 13)
+	header[0] = frameType
+	binary.BigEndian.PutUint64(header[1:9], uint64(connID))
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(payload)))
+
+	tunnel.writeMutex.Lock()
+	defer tunnel.writeMutex.Unlock()
+
+	_, err := tunnel.controlConn.Write(header)
+	if err != nil {
+		return ContextError(err)
+	}
+	if len(payload) > 0 {
+		_, err = tunnel.controlConn.Write(payload)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+	return nil
+}
+
+func (tunnel *MultiplexTunnel) readFrame() (frameType byte, connID int64, payload []byte, err error) {
+	header := make([]byte, 13)
+	_, err = io.ReadFull(tunnel.controlConn, header)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	frameType = header[0]
+	connID = int64(binary.BigEndian.Uint64(header[1:9]))
+	payloadLength := binary.BigEndian.Uint32(header[9:13])
+	if payloadLength > 0 {
+		payload = make([]byte, payloadLength)
+		_, err = io.ReadFull(tunnel.controlConn, payload)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	return frameType, connID, payload, nil
+}
+
+// muxConn implements net.Conn for a single logical connection
+// multiplexed over a MultiplexTunnel's control stream. deliver, called
+// by the tunnel's single reader goroutine, appends to an unbounded queue
+// and never blocks, so one slow/stalled muxConn cannot stall the demux
+// loop and starve every other conn and pending dial. Write chunks
+// payloads into DATA frames under the tunnel's shared write mutex.
+type muxConn struct {
+	tunnel *MultiplexTunnel
+	connID int64
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	queue    [][]byte
+	pending  []byte
+	closeErr error
+	closed   bool
+
+	readDeadline  time.Time
+	readTimer     *time.Timer
+	writeDeadline time.Time
+}
+
+func newMuxConn(tunnel *MultiplexTunnel, connID int64) *muxConn {
+	conn := &muxConn{
+		tunnel: tunnel,
+		connID: connID,
+	}
+	conn.cond = sync.NewCond(&conn.mutex)
+	return conn
+}
+
+// deliver queues payload for Read. It is a no-op once the conn is
+// closed/closing, so a DATA frame that arrives after a local Close()
+// (an ordinary race with the remote end) is simply dropped.
+func (conn *muxConn) deliver(payload []byte) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.closed {
+		return
+	}
+	conn.queue = append(conn.queue, payload)
+	conn.cond.Signal()
+}
+
+func (conn *muxConn) closeWithError(err error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+	conn.closeErr = err
+	conn.cond.Broadcast()
+}
+
+func (conn *muxConn) Read(b []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	for len(conn.pending) == 0 {
+		if len(conn.queue) > 0 {
+			conn.pending = conn.queue[0]
+			conn.queue = conn.queue[1:]
+			break
+		}
+		if conn.closed {
+			err := conn.closeErr
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		if !conn.readDeadline.IsZero() && !time.Now().Before(conn.readDeadline) {
+			return 0, errMuxConnTimeout
+		}
+		conn.cond.Wait()
+	}
+
+	n := copy(b, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
+
+func (conn *muxConn) Write(b []byte) (int, error) {
+	const maxFramePayload = 16 * 1024
+
+	conn.mutex.Lock()
+	writeDeadline := conn.writeDeadline
+	conn.mutex.Unlock()
+
+	// controlConn is shared by every muxConn multiplexed over the
+	// tunnel, so this deadline is necessarily a coarse, best-effort
+	// approximation: it bounds how long this Write call's frames may
+	// take to flush, but a deadline set by one muxConn's Write also
+	// bounds any concurrent Write from another.
+	if err := conn.tunnel.controlConn.SetWriteDeadline(writeDeadline); err != nil {
+		return 0, ContextError(err)
+	}
+
+	written := 0
+	for written < len(b) {
+		end := written + maxFramePayload
+		if end > len(b) {
+			end = len(b)
+		}
+		err := conn.tunnel.writeFrame(muxFrameData, conn.connID, b[written:end])
+		if err != nil {
+			return written, ContextError(err)
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (conn *muxConn) Close() error {
+	conn.closeWithError(io.EOF)
+	conn.mutex.Lock()
+	if conn.readTimer != nil {
+		conn.readTimer.Stop()
+	}
+	conn.mutex.Unlock()
+	conn.tunnel.removeConn(conn.connID)
+	return conn.tunnel.writeFrame(muxFrameCloseRequest, conn.connID, nil)
+}
+
+func (conn *muxConn) LocalAddr() net.Addr  { return conn.tunnel.controlConn.LocalAddr() }
+func (conn *muxConn) RemoteAddr() net.Addr { return conn.tunnel.controlConn.RemoteAddr() }
+
+// errMuxConnTimeout is returned, unwrapped, by Read when
+// readDeadline has passed. It implements net.Error so that callers such
+// as http.Transport can recognize it as a timeout.
+var errMuxConnTimeout = &muxConnTimeoutError{}
+
+type muxConnTimeoutError struct{}
+
+func (*muxConnTimeoutError) Error() string   { return "muxConn read deadline exceeded" }
+func (*muxConnTimeoutError) Timeout() bool   { return true }
+func (*muxConnTimeoutError) Temporary() bool { return true }
+
+func (conn *muxConn) SetDeadline(t time.Time) error {
+	if err := conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline arranges for a pending or future Read to fail with a
+// timeout once t passes. Since Read blocks on a sync.Cond rather than a
+// channel with native timeout support, a timer wakes the waiting Read
+// (if any) once the deadline elapses.
+func (conn *muxConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.readDeadline = t
+	if conn.readTimer != nil {
+		conn.readTimer.Stop()
+		conn.readTimer = nil
+	}
+	if !t.IsZero() {
+		conn.readTimer = time.AfterFunc(time.Until(t), func() {
+			conn.mutex.Lock()
+			conn.cond.Broadcast()
+			conn.mutex.Unlock()
+		})
+	}
+	return nil
+}
+
+// SetWriteDeadline records the deadline applied to controlConn by the
+// next Write from this muxConn.
+func (conn *muxConn) SetWriteDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	conn.writeDeadline = t
+	conn.mutex.Unlock()
+	return nil
+}
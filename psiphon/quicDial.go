@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// quicSessionCacheEntry holds a QUIC session that is shared by all streams
+// dialed to the same remote address, along with a reference count of the
+// streams currently using it.
+type quicSessionCacheEntry struct {
+	session  quic.Session
+	refCount int
+}
+
+// quicSessionCache caches and reference-counts QUIC sessions so that
+// repeated dials to the same Psiphon server endpoint reuse a single
+// underlying session, multiplexing streams over it instead of performing
+// a new QUIC handshake for each dial.
+var quicSessionCache = struct {
+	mutex   sync.Mutex
+	entries map[string]*quicSessionCacheEntry
+}{
+	entries: make(map[string]*quicSessionCacheEntry),
+}
+
+// NewQUICDialer creates a Dialer, compatible with http.Transport.Dial,
+// that carries streams over a cached, reference-counted QUIC session to
+// addr. One session per remote endpoint is established and reused; when
+// the last stream dialed against a session is closed, the session is
+// torn down. tlsConfig specifies the TLS configuration used for the QUIC
+// handshake, which may set a spoofed SNI distinct from the dial address.
+func NewQUICDialer(dialConfig *DialConfig, tlsConfig *tls.Config) Dialer {
+	return func(network, addr string) (net.Conn, error) {
+		return quicDial(addr, dialConfig, tlsConfig)
+	}
+}
+
+func quicDial(addr string, dialConfig *DialConfig, tlsConfig *tls.Config) (net.Conn, error) {
+
+	session, err := acquireQUICSession(addr, dialConfig, tlsConfig)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	stream, err := session.session.OpenStreamSync()
+	if err != nil {
+		// OpenStreamSync failing indicates the underlying session (and its
+		// UDP socket) is no longer usable -- evict it outright rather than
+		// merely decrementing its reference count, so it isn't handed to
+		// later dials, which would otherwise fail against it forever.
+		evictQUICSession(addr, session)
+		return nil, ContextError(err)
+	}
+
+	return &quicStreamConn{
+		Stream:  stream,
+		session: session,
+		addr:    addr,
+		local:   session.session.LocalAddr(),
+		remote:  session.session.RemoteAddr(),
+	}, nil
+}
+
+func acquireQUICSession(
+	addr string, dialConfig *DialConfig, tlsConfig *tls.Config) (*quicSessionCacheEntry, error) {
+
+	quicSessionCache.mutex.Lock()
+	defer quicSessionCache.mutex.Unlock()
+
+	if entry, ok := quicSessionCache.entries[addr]; ok {
+		entry.refCount++
+		return entry, nil
+	}
+
+	packetConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if dialConfig.PendingConns != nil {
+		// net.UDPConn satisfies net.Conn, so it may be added directly to
+		// PendingConns; CloseAll will close the UDP socket, which tears
+		// down any multiplexed streams riding on top of it.
+		if !dialConfig.PendingConns.Add(packetConn) {
+			packetConn.Close()
+			return nil, ContextError(errors.New("pending conns already closed"))
+		}
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		packetConn.Close()
+		return nil, ContextError(err)
+	}
+
+	quicTLSConfig := tlsConfig
+	if quicTLSConfig == nil {
+		quicTLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	session, err := quic.Dial(
+		packetConn,
+		udpAddr,
+		addr,
+		quicTLSConfig,
+		&quic.Config{})
+	if err != nil {
+		if dialConfig.PendingConns != nil {
+			dialConfig.PendingConns.Remove(packetConn)
+		}
+		packetConn.Close()
+		return nil, ContextError(err)
+	}
+
+	entry := &quicSessionCacheEntry{session: session, refCount: 1}
+	quicSessionCache.entries[addr] = entry
+	return entry, nil
+}
+
+// evictQUICSession removes entry from the session cache, if it is still
+// the entry cached for addr, and closes its session. Unlike
+// releaseQUICSession, this is unconditional on refCount: it is called
+// when the session itself has proven unusable (e.g. OpenStreamSync
+// failed, typically because the underlying UDP socket was torn down by
+// PendingConns.CloseAll), so the entry must not be handed to later
+// dials regardless of how many streams still reference it. The identity
+// check guards against a race where a concurrent dial already evicted
+// and replaced this entry.
+func evictQUICSession(addr string, entry *quicSessionCacheEntry) {
+	quicSessionCache.mutex.Lock()
+	defer quicSessionCache.mutex.Unlock()
+
+	if quicSessionCache.entries[addr] == entry {
+		delete(quicSessionCache.entries, addr)
+	}
+	entry.session.Close()
+}
+
+func releaseQUICSession(addr string, entry *quicSessionCacheEntry) {
+	quicSessionCache.mutex.Lock()
+	defer quicSessionCache.mutex.Unlock()
+
+	entry.refCount--
+	if entry.refCount <= 0 {
+		entry.session.Close()
+		if quicSessionCache.entries[addr] == entry {
+			delete(quicSessionCache.entries, addr)
+		}
+	}
+}
+
+// quicStreamConn adapts a quic.Stream, which lacks LocalAddr/RemoteAddr,
+// into a net.Conn backed by the underlying shared session, and releases
+// the session's reference count when closed.
+type quicStreamConn struct {
+	quic.Stream
+	session *quicSessionCacheEntry
+	addr    string
+	local   net.Addr
+	remote  net.Addr
+}
+
+func (conn *quicStreamConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *quicStreamConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *quicStreamConn) Close() error {
+	err := conn.Stream.Close()
+	releaseQUICSession(conn.addr, conn.session)
+	return err
+}
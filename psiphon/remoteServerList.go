@@ -21,107 +21,241 @@ package psiphon
 
 import (
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 )
 
+const (
+	remoteServerListSignatureAlgorithmRsaSha256 = "rsa-sha256"
+	remoteServerListSignatureAlgorithmEd25519   = "ed25519"
+)
+
 // RemoteServerList is a JSON record containing a list of Psiphon server
 // entries. As it may be downloaded from various sources, it is digitally
-// signed so that the data may be authenticated.
+// signed so that the data may be authenticated. SequenceNumber is a
+// monotonically increasing value assigned by the publisher, used to
+// reject replay of an older, previously valid list (a rollback attack).
 type RemoteServerList struct {
 	Data                   string `json:"data"`
 	SigningPublicKeyDigest string `json:"signingPublicKeyDigest"`
 	Signature              string `json:"signature"`
+	Algorithm              string `json:"algorithm"`
+	SequenceNumber         int64  `json:"sequenceNumber"`
+}
+
+// RemoteServerListSignaturePublicKey is one trusted public key used to
+// verify a RemoteServerList signature. DigestEncoded is the base64-encoded
+// SHA-256 digest of the decoded public key bytes (DER-encoded PKIX for
+// rsa-sha256, the raw 32-byte key for ed25519), precomputed so that
+// validateRemoteServerList can select the matching key without hashing
+// every candidate on each call. Multiple keys allow rotating the signing
+// key without invalidating lists signed with the previous key.
+type RemoteServerListSignaturePublicKey struct {
+	DigestEncoded    string
+	PublicKeyEncoded string
+	Algorithm        string
 }
 
 // FetchRemoteServerList downloads a remote server list JSON record from
-// config.RemoteServerListUrl; validates its digital signature using the
-// public key config.RemoteServerListSignaturePublicKey; and parses the
-// data field into ServerEntry records.
+// one of config.RemoteServerListUrls; validates its digital signature
+// against config.RemoteServerListSignaturePublicKeys; and parses the
+// data field into ServerEntry records. The mirror URLs are tried in
+// random order, each with its own timeout, and the fetch succeeds as
+// soon as one mirror returns a validly signed list.
 func FetchRemoteServerList(config *Config, pendingConns *Conns) (err error) {
 	NoticeInfo("fetching remote server list")
 
-	// Note: pendingConns may be used to interrupt the fetch remote server list
-	// request. BindToDevice may be used to exclude requests from VPN routing.
+	urls := make([]string, len(config.RemoteServerListUrls))
+	copy(urls, config.RemoteServerListUrls)
+	rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+
+	var lastErr error
+	for _, url := range urls {
+		remoteServerList, fetchErr := fetchRemoteServerListFromURL(config, pendingConns, url)
+		if fetchErr != nil {
+			lastErr = fetchErr
+			NoticeAlert("fetch remote server list from %s failed: %s", url, ContextError(fetchErr))
+			continue
+		}
+
+		err = validateRemoteServerList(config, remoteServerList)
+		if err != nil {
+			lastErr = err
+			NoticeAlert("validate remote server list from %s failed: %s", url, ContextError(err))
+			continue
+		}
+
+		lastSequenceNumber, err := GetRemoteServerListSequenceNumber()
+		if err != nil {
+			return ContextError(err)
+		}
+		if remoteServerList.SequenceNumber < lastSequenceNumber {
+			lastErr = ContextError(errors.New("remote server list sequence number rollback"))
+			NoticeAlert("rejecting remote server list from %s: %s", url, lastErr)
+			continue
+		}
+
+		serverEntries, err := DecodeAndValidateServerEntryList(remoteServerList.Data)
+		if err != nil {
+			return ContextError(err)
+		}
+
+		err = StoreServerEntries(serverEntries, true)
+		if err != nil {
+			return ContextError(err)
+		}
+
+		return SetRemoteServerListSequenceNumber(remoteServerList.SequenceNumber)
+	}
+
+	return ContextError(fmt.Errorf("all remote server list mirrors failed: %s", lastErr))
+}
+
+func fetchRemoteServerListFromURL(
+	config *Config, pendingConns *Conns, url string) (*RemoteServerList, error) {
+
 	dialConfig := &DialConfig{
-		UpstreamHttpProxyAddress: config.UpstreamHttpProxyAddress,
-		PendingConns:             pendingConns,
-		BindToDeviceProvider:     config.BindToDeviceProvider,
-		BindToDeviceDnsServer:    config.BindToDeviceDnsServer,
+		UpstreamHttpProxyAddress:  config.UpstreamHttpProxyAddress,
+		UpstreamSocksProxyAddress: config.UpstreamSocksProxyAddress,
+		UpstreamProxyUsername:     config.UpstreamProxyUsername,
+		UpstreamProxyPassword:     config.UpstreamProxyPassword,
+		PendingConns:              pendingConns,
+		BindToDeviceProvider:      config.BindToDeviceProvider,
+		BindToDeviceDnsServer:     config.BindToDeviceDnsServer,
+	}
+
+	var dial Dialer
+	if config.RemoteServerListUseQUIC {
+		// The QUIC dialer carries the fetch over a UDP/QUIC session instead
+		// of TCP, which can succeed where TCP is throttled or blocked.
+		dial = NewQUICDialer(dialConfig, &tls.Config{ServerName: config.RemoteServerListQUICSni})
+	} else {
+		dial = NewTCPDialer(dialConfig)
 	}
 	transport := &http.Transport{
-		Dial: NewTCPDialer(dialConfig),
+		Dial: dial,
 	}
 	httpClient := http.Client{
 		Timeout:   FETCH_REMOTE_SERVER_LIST_TIMEOUT,
 		Transport: transport,
 	}
 
-	response, err := httpClient.Get(config.RemoteServerListUrl)
+	response, err := httpClient.Get(url)
 	if err != nil {
-		return ContextError(err)
+		return nil, ContextError(err)
 	}
 	defer response.Body.Close()
 
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return ContextError(err)
+		return nil, ContextError(err)
 	}
 
 	var remoteServerList *RemoteServerList
 	err = json.Unmarshal(body, &remoteServerList)
 	if err != nil {
-		return ContextError(err)
-	}
-	err = validateRemoteServerList(config, remoteServerList)
-	if err != nil {
-		return ContextError(err)
-	}
-
-	serverEntries, err := DecodeAndValidateServerEntryList(remoteServerList.Data)
-	if err != nil {
-		return ContextError(err)
+		return nil, ContextError(err)
 	}
 
-	err = StoreServerEntries(serverEntries, true)
-	if err != nil {
-		return ContextError(err)
-	}
-
-	return nil
+	return remoteServerList, nil
 }
 
+// validateRemoteServerList selects the trusted public key whose digest
+// matches remoteServerList.SigningPublicKeyDigest -- rejecting the
+// payload outright if no configured key matches, which defends against
+// downgrade/substitution to an untrusted key -- and then verifies the
+// signature using that key's algorithm (RSA-PKCS1v15/SHA-256 or Ed25519).
 func validateRemoteServerList(config *Config, remoteServerList *RemoteServerList) (err error) {
-	derEncodedPublicKey, err := base64.StdEncoding.DecodeString(config.RemoteServerListSignaturePublicKey)
-	if err != nil {
-		return ContextError(err)
+
+	var matchedKey *RemoteServerListSignaturePublicKey
+	for _, key := range config.RemoteServerListSignaturePublicKeys {
+		if key.DigestEncoded == remoteServerList.SigningPublicKeyDigest {
+			matchedKey = &key
+			break
+		}
+	}
+	if matchedKey == nil {
+		return ContextError(errors.New("no signing public key matches signingPublicKeyDigest"))
 	}
-	publicKey, err := x509.ParsePKIXPublicKey(derEncodedPublicKey)
+
+	derEncodedPublicKey, err := base64.StdEncoding.DecodeString(matchedKey.PublicKeyEncoded)
 	if err != nil {
 		return ContextError(err)
 	}
-	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
-	if !ok {
-		return ContextError(errors.New("unexpected RemoteServerListSignaturePublicKey key type"))
-	}
 	signature, err := base64.StdEncoding.DecodeString(remoteServerList.Signature)
 	if err != nil {
 		return ContextError(err)
 	}
-	// TODO: can detect if signed with different key --
-	// match digest(publicKey) against remoteServerList.signingPublicKeyDigest
-	hash := sha256.New()
-	hash.Write([]byte(remoteServerList.Data))
-	digest := hash.Sum(nil)
-	err = rsa.VerifyPKCS1v15(rsaPublicKey, crypto.SHA256, digest, signature)
-	if err != nil {
-		return ContextError(err)
+
+	algorithm := remoteServerList.Algorithm
+	if algorithm == "" {
+		algorithm = remoteServerListSignatureAlgorithmRsaSha256
+	}
+	if algorithm != matchedKey.Algorithm {
+		return ContextError(fmt.Errorf(
+			"remote server list algorithm %s does not match trusted key algorithm %s",
+			algorithm, matchedKey.Algorithm))
+	}
+
+	switch algorithm {
+
+	case remoteServerListSignatureAlgorithmRsaSha256:
+		publicKey, err := x509.ParsePKIXPublicKey(derEncodedPublicKey)
+		if err != nil {
+			return ContextError(err)
+		}
+		rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return ContextError(errors.New("unexpected RemoteServerListSignaturePublicKey key type"))
+		}
+		hash := sha256.New()
+		hash.Write([]byte(remoteServerList.Data))
+		digest := hash.Sum(nil)
+		err = rsa.VerifyPKCS1v15(rsaPublicKey, crypto.SHA256, digest, signature)
+		if err != nil {
+			return ContextError(err)
+		}
+
+	case remoteServerListSignatureAlgorithmEd25519:
+		if len(derEncodedPublicKey) != ed25519.PublicKeySize {
+			return ContextError(errors.New("invalid Ed25519 public key length"))
+		}
+		if !ed25519.Verify(ed25519.PublicKey(derEncodedPublicKey), []byte(remoteServerList.Data), signature) {
+			return ContextError(errors.New("invalid Ed25519 signature"))
+		}
+
+	default:
+		return ContextError(fmt.Errorf("unsupported signature algorithm: %s", algorithm))
 	}
+
 	return nil
 }
+
+// NewRemoteServerListSignaturePublicKey computes and stores the SHA-256
+// digest of publicKeyEncoded (a base64-encoded public key: DER-encoded
+// PKIX for rsa-sha256, the raw 32-byte key for ed25519),
+// for use in the config's RemoteServerListSignaturePublicKeys list.
+func NewRemoteServerListSignaturePublicKey(
+	algorithm, publicKeyEncoded string) (*RemoteServerListSignaturePublicKey, error) {
+
+	derEncodedPublicKey, err := base64.StdEncoding.DecodeString(publicKeyEncoded)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	hash := sha256.Sum256(derEncodedPublicKey)
+	return &RemoteServerListSignaturePublicKey{
+		DigestEncoded:    base64.StdEncoding.EncodeToString(hash[:]),
+		PublicKeyEncoded: publicKeyEncoded,
+		Algorithm:        algorithm,
+	}, nil
+}
@@ -0,0 +1,290 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// SecureResolver configures an encrypted DNS resolver to use in place of
+// the plaintext DialConfig.BindToDeviceDnsServer. Exactly one of DoH, DoT,
+// or DNSCrypt should be set.
+type SecureResolver struct {
+	DoH      *DoHResolver
+	DoT      *DoTResolver
+	DNSCrypt *DNSCryptResolver
+}
+
+// DoHResolver configures DNS-over-HTTPS (RFC 8484).
+type DoHResolver struct {
+	URL          string
+	BootstrapIPs []string
+}
+
+// DoTResolver configures DNS-over-TLS (RFC 7858).
+type DoTResolver struct {
+	Host    string
+	IP      string
+	SPKIPin string
+}
+
+// DNSCryptResolver configures DNSCrypt v2 via an sdns:// stamp.
+type DNSCryptResolver struct {
+	StampSDNS string
+}
+
+// ResolveIPAddress resolves hostname to an IP address using the
+// configured SecureResolver, dialing the resolver itself through a
+// bind-to-device socket (via dialConfig.BindToDeviceProvider) so the DNS
+// query is excluded from VPN routing the same way TCP dials already are.
+// When secureResolver is nil, dialConfig.BindToDeviceDnsServer is used as
+// a plaintext fallback, as before; this fallback must be explicitly
+// permitted by the caller.
+func ResolveIPAddress(hostname string, dialConfig *DialConfig, secureResolver *SecureResolver) (string, error) {
+
+	if secureResolver == nil {
+		if dialConfig.BindToDeviceDnsServer == "" {
+			return "", ContextError(errors.New("no resolver configured"))
+		}
+		return resolvePlaintextUDP(hostname, dialConfig)
+	}
+
+	switch {
+	case secureResolver.DoH != nil:
+		return resolveDoH(hostname, dialConfig, secureResolver.DoH)
+	case secureResolver.DoT != nil:
+		return resolveDoT(hostname, dialConfig, secureResolver.DoT)
+	case secureResolver.DNSCrypt != nil:
+		return resolveDNSCrypt(hostname, dialConfig, secureResolver.DNSCrypt)
+	}
+
+	return "", ContextError(errors.New("SecureResolver has no resolver configured"))
+}
+
+func resolvePlaintextUDP(hostname string, dialConfig *DialConfig) (string, error) {
+	conn, err := dialBoundUDP(dialConfig.BindToDeviceDnsServer, dialConfig)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	defer conn.Close()
+	return exchangeDNSMessage(conn, hostname)
+}
+
+// resolveDoH performs DNS-over-HTTPS: a DNS wireformat query is POSTed,
+// over a bind-to-device TCP connection, to doh.URL (resolved using
+// doh.BootstrapIPs to avoid a circular DNS dependency).
+func resolveDoH(hostname string, dialConfig *DialConfig, doh *DoHResolver) (string, error) {
+
+	query, err := buildDNSQuery(hostname, dnsRecordTypeA)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	// The bootstrap dialer has SecureResolver cleared: resolving the DoH
+	// server's own hostname via the DoH server itself would recurse
+	// forever, so BootstrapIPs are used to reach it instead.
+	boundDialConfig := *dialConfig
+	boundDialConfig.SecureResolver = nil
+	transport := &http.Transport{
+		Dial: newBootstrappedDialer(&boundDialConfig, doh.BootstrapIPs),
+	}
+	httpClient := http.Client{Transport: transport}
+
+	request, err := http.NewRequest("POST", doh.URL, bytes.NewReader(query))
+	if err != nil {
+		return "", ContextError(err)
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	return parseDNSAnswer(body)
+}
+
+// resolveDoT performs DNS-over-TLS: the wireformat query, length-prefixed
+// per RFC 1035 section 4.2.2, is sent over a bind-to-device TCP
+// connection wrapped in TLS, optionally pinned to dot.SPKIPin.
+func resolveDoT(hostname string, dialConfig *DialConfig, dot *DoTResolver) (string, error) {
+
+	rawConn, err := dialBoundTCP(net.JoinHostPort(dot.IP, "853"), dialConfig)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	defer rawConn.Close()
+
+	tlsConfig := &tls.Config{ServerName: dot.Host}
+	if dot.SPKIPin != "" {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = makeSPKIPinVerifier(dot.SPKIPin)
+	}
+	tlsConn := tls.Client(rawConn, tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	query, err := buildDNSQuery(hostname, dnsRecordTypeA)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	lengthPrefixed := make([]byte, 2+len(query))
+	lengthPrefixed[0] = byte(len(query) >> 8)
+	lengthPrefixed[1] = byte(len(query) & 0xff)
+	copy(lengthPrefixed[2:], query)
+
+	_, err = tlsConn.Write(lengthPrefixed)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	return readLengthPrefixedDNSAnswer(tlsConn)
+}
+
+// resolveDNSCrypt performs a DNSCrypt v2 query: the certificate for the
+// provider named in the sdns:// stamp is fetched (and cached until its
+// TTL expires), then the query is encrypted with XSalsa20-Poly1305 under
+// a key derived from an ephemeral X25519 key pair and the certificate's
+// resolver public key, per the DNSCrypt v2 spec.
+func resolveDNSCrypt(hostname string, dialConfig *DialConfig, dnsCrypt *DNSCryptResolver) (string, error) {
+
+	stamp, err := parseDNSCryptStamp(dnsCrypt.StampSDNS)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	cert, err := getCachedDNSCryptCertificate(stamp, dialConfig)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	query, err := buildDNSQuery(hostname, dnsRecordTypeA)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	encryptedQuery, clientNonce, clientEphemeralPrivateKey, err :=
+		encryptDNSCryptQuery(query, cert)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	conn, err := dialBoundUDP(stamp.ResolverAddress, dialConfig)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(encryptedQuery)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	responseBuffer := make([]byte, 4096)
+	n, err := conn.Read(responseBuffer)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	answer, err := decryptDNSCryptResponse(
+		responseBuffer[:n], cert, clientNonce, clientEphemeralPrivateKey)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	return parseDNSAnswer(answer)
+}
+
+// makeSPKIPinVerifier returns a tls.Config.VerifyPeerCertificate callback
+// that accepts the connection only if the leaf certificate's SHA-256
+// SubjectPublicKeyInfo digest matches the base64-encoded spkiPin. This is
+// used in place of normal chain verification, which is disabled via
+// InsecureSkipVerify, so that DoT can pin to a known resolver key.
+func makeSPKIPinVerifier(spkiPin string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ContextError(errors.New("no server certificate presented"))
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return ContextError(err)
+		}
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if base64.StdEncoding.EncodeToString(digest[:]) != spkiPin {
+			return ContextError(errors.New("SPKI pin mismatch"))
+		}
+		return nil
+	}
+}
+
+// newBootstrappedDialer returns a Dialer that substitutes the first of
+// bootstrapIPs for the hostname component of whatever address it is
+// asked to dial, used to reach a DoH server without depending on DNS
+// resolution of the server's own hostname.
+func newBootstrappedDialer(dialConfig *DialConfig, bootstrapIPs []string) Dialer {
+	tcpDialer := NewTCPDialer(dialConfig)
+	return func(network, addr string) (net.Conn, error) {
+		if len(bootstrapIPs) == 0 {
+			return tcpDialer(network, addr)
+		}
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		return tcpDialer(network, net.JoinHostPort(bootstrapIPs[0], port))
+	}
+}
+
+// dialBoundTCP establishes a TCP connection to addr, submitting the
+// socket to dialConfig.BindToDeviceProvider before connecting, using the
+// same plumbing as NewTCPDialer.
+func dialBoundTCP(addr string, dialConfig *DialConfig) (net.Conn, error) {
+	boundDialConfig := *dialConfig
+	boundDialConfig.UpstreamHttpProxyAddress = ""
+	boundDialConfig.UpstreamSocksProxyAddress = ""
+	return dialRawConn("tcp", addr, &boundDialConfig)
+}
+
+// dialBoundUDP establishes a UDP "connection" to addr, submitting the
+// socket to dialConfig.BindToDeviceProvider before use.
+func dialBoundUDP(addr string, dialConfig *DialConfig) (net.Conn, error) {
+	boundDialConfig := *dialConfig
+	boundDialConfig.UpstreamHttpProxyAddress = ""
+	boundDialConfig.UpstreamSocksProxyAddress = ""
+	return dialRawConn("udp", addr, &boundDialConfig)
+}
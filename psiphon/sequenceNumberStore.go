@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RemoteServerListSequenceNumberFilename is the name of the file, stored
+// under DataStoreDirectory, that persists the last-accepted
+// RemoteServerList sequence number across runs, so a later fetch of an
+// older, previously valid list is rejected as a rollback rather than
+// silently readopted on every process start.
+const RemoteServerListSequenceNumberFilename = "remote_server_list_sequence_number"
+
+// DataStoreDirectory is the directory in which small pieces of
+// persistent state, such as the RemoteServerList sequence number, are
+// stored. It defaults to the current working directory and may be set
+// by the caller before the first call to GetRemoteServerListSequenceNumber
+// or SetRemoteServerListSequenceNumber.
+var DataStoreDirectory = "."
+
+var sequenceNumberStore = struct {
+	mutex   sync.Mutex
+	loaded  bool
+	current int64
+}{}
+
+type sequenceNumberRecord struct {
+	SequenceNumber int64 `json:"sequenceNumber"`
+}
+
+// GetRemoteServerListSequenceNumber returns the last-persisted
+// RemoteServerList sequence number, or 0 if none has been stored yet.
+func GetRemoteServerListSequenceNumber() (int64, error) {
+	sequenceNumberStore.mutex.Lock()
+	defer sequenceNumberStore.mutex.Unlock()
+
+	if sequenceNumberStore.loaded {
+		return sequenceNumberStore.current, nil
+	}
+
+	sequenceNumber, err := loadRemoteServerListSequenceNumber()
+	if err != nil {
+		return 0, ContextError(err)
+	}
+
+	sequenceNumberStore.current = sequenceNumber
+	sequenceNumberStore.loaded = true
+	return sequenceNumber, nil
+}
+
+// SetRemoteServerListSequenceNumber persists sequenceNumber as the
+// last-accepted RemoteServerList sequence number.
+func SetRemoteServerListSequenceNumber(sequenceNumber int64) error {
+	sequenceNumberStore.mutex.Lock()
+	defer sequenceNumberStore.mutex.Unlock()
+
+	err := storeRemoteServerListSequenceNumber(sequenceNumber)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	sequenceNumberStore.current = sequenceNumber
+	sequenceNumberStore.loaded = true
+	return nil
+}
+
+func remoteServerListSequenceNumberFilePath() string {
+	return filepath.Join(DataStoreDirectory, RemoteServerListSequenceNumberFilename)
+}
+
+func loadRemoteServerListSequenceNumber() (int64, error) {
+	path := remoteServerListSequenceNumberFilePath()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, ContextError(err)
+	}
+
+	var record sequenceNumberRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+
+	return record.SequenceNumber, nil
+}
+
+func storeRemoteServerListSequenceNumber(sequenceNumber int64) error {
+	data, err := json.Marshal(sequenceNumberRecord{SequenceNumber: sequenceNumber})
+	if err != nil {
+		return ContextError(err)
+	}
+
+	path := remoteServerListSequenceNumberFilePath()
+
+	// Write to a temporary file and rename, so a crash or power loss
+	// mid-write cannot leave a truncated/corrupt record that silently
+	// resets the rollback check to 0.
+	tempFile, err := ioutil.TempFile(DataStoreDirectory, RemoteServerListSequenceNumberFilename+".tmp")
+	if err != nil {
+		return ContextError(err)
+	}
+	_, err = tempFile.Write(data)
+	if err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return ContextError(err)
+	}
+	err = tempFile.Close()
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return ContextError(err)
+	}
+
+	err = os.Rename(tempFile.Name(), path)
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return ContextError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socksVersion5 = 0x05
+
+	socksAuthMethodNoAuth             = 0x00
+	socksAuthMethodUsernamePassword   = 0x02
+	socksAuthMethodNoAcceptableMethod = 0xff
+
+	socksCommandConnect = 0x01
+
+	socksAddressTypeIPv4       = 0x01
+	socksAddressTypeDomainName = 0x03
+	socksAddressTypeIPv6       = 0x04
+
+	socksReplySucceeded = 0x00
+)
+
+// socksConnect establishes a connection to addr through an established
+// network connection to a SOCKS5 proxy (RFC 1928), optionally
+// authenticating with a username and password (RFC 1929). It is assumed
+// that no payload bytes have been sent through the connection to the
+// proxy. The ATYP=DomainName address type is used for hostnames so that
+// DNS resolution happens at the proxy, not the client.
+func socksConnect(rawConn net.Conn, addr, username, password string) (err error) {
+
+	useAuth := username != "" || password != ""
+
+	methods := []byte{socksAuthMethodNoAuth}
+	if useAuth {
+		methods = []byte{socksAuthMethodUsernamePassword}
+	}
+
+	greeting := make([]byte, 0, 2+len(methods))
+	greeting = append(greeting, socksVersion5, byte(len(methods)))
+	greeting = append(greeting, methods...)
+	_, err = rawConn.Write(greeting)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	methodResponse := make([]byte, 2)
+	_, err = io.ReadFull(rawConn, methodResponse)
+	if err != nil {
+		return ContextError(err)
+	}
+	if methodResponse[0] != socksVersion5 {
+		return ContextError(errors.New("unexpected SOCKS version"))
+	}
+	if methodResponse[1] == socksAuthMethodNoAcceptableMethod {
+		return ContextError(errors.New("SOCKS proxy rejected all authentication methods"))
+	}
+
+	if methodResponse[1] == socksAuthMethodUsernamePassword {
+		err = socksAuthenticate(rawConn, username, password)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+
+	hostname, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ContextError(err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return ContextError(errors.New("invalid port"))
+	}
+
+	request := make([]byte, 0, 7+len(hostname))
+	request = append(request, socksVersion5, socksCommandConnect, 0x00, socksAddressTypeDomainName)
+	request = append(request, byte(len(hostname)))
+	request = append(request, []byte(hostname)...)
+	request = append(request, byte(portNumber>>8), byte(portNumber&0xff))
+	_, err = rawConn.Write(request)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	// Read the fixed header (VER, REP, RSV, ATYP), then consume the
+	// remainder of the bound address/port, which we don't use.
+	replyHeader := make([]byte, 4)
+	_, err = io.ReadFull(rawConn, replyHeader)
+	if err != nil {
+		return ContextError(err)
+	}
+	if replyHeader[0] != socksVersion5 {
+		return ContextError(errors.New("unexpected SOCKS version"))
+	}
+	if replyHeader[1] != socksReplySucceeded {
+		return ContextError(fmt.Errorf("SOCKS proxy CONNECT failed with reply code %d", replyHeader[1]))
+	}
+
+	var addressLength int
+	switch replyHeader[3] {
+	case socksAddressTypeIPv4:
+		addressLength = net.IPv4len
+	case socksAddressTypeIPv6:
+		addressLength = net.IPv6len
+	case socksAddressTypeDomainName:
+		domainLength := make([]byte, 1)
+		_, err = io.ReadFull(rawConn, domainLength)
+		if err != nil {
+			return ContextError(err)
+		}
+		addressLength = int(domainLength[0])
+	default:
+		return ContextError(errors.New("unexpected SOCKS address type"))
+	}
+	_, err = io.ReadFull(rawConn, make([]byte, addressLength+2))
+	if err != nil {
+		return ContextError(err)
+	}
+
+	return nil
+}
+
+// socksAuthenticate performs the SOCKS5 username/password authentication
+// sub-negotiation (RFC 1929).
+func socksAuthenticate(rawConn net.Conn, username, password string) (err error) {
+	if len(username) > 255 || len(password) > 255 {
+		return ContextError(errors.New("SOCKS username or password too long"))
+	}
+
+	request := make([]byte, 0, 3+len(username)+len(password))
+	request = append(request, 0x01, byte(len(username)))
+	request = append(request, []byte(username)...)
+	request = append(request, byte(len(password)))
+	request = append(request, []byte(password)...)
+	_, err = rawConn.Write(request)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	response := make([]byte, 2)
+	_, err = io.ReadFull(rawConn, response)
+	if err != nil {
+		return ContextError(err)
+	}
+	if response[1] != 0x00 {
+		return ContextError(errors.New("SOCKS proxy rejected credentials"))
+	}
+
+	return nil
+}
+
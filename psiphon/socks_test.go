@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// serveSOCKSConnect plays the server side of a SOCKS5 CONNECT negotiation
+// over conn, accepting requireAuth when set, then returns.
+func serveSOCKSConnect(t *testing.T, conn net.Conn, requireAuth bool) {
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		t.Errorf("read greeting: %s", err)
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		t.Errorf("read methods: %s", err)
+		return
+	}
+
+	if requireAuth {
+		conn.Write([]byte{socksVersion5, socksAuthMethodUsernamePassword})
+
+		authHeader := make([]byte, 2)
+		if _, err := io.ReadFull(conn, authHeader); err != nil {
+			t.Errorf("read auth header: %s", err)
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, authHeader[1])); err != nil {
+			t.Errorf("read username: %s", err)
+			return
+		}
+		passwordLength := make([]byte, 1)
+		if _, err := io.ReadFull(conn, passwordLength); err != nil {
+			t.Errorf("read password length: %s", err)
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, passwordLength[0])); err != nil {
+			t.Errorf("read password: %s", err)
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	} else {
+		conn.Write([]byte{socksVersion5, socksAuthMethodNoAuth})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		t.Errorf("read request: %s", err)
+		return
+	}
+	domainLength := make([]byte, 1)
+	if _, err := io.ReadFull(conn, domainLength); err != nil {
+		t.Errorf("read domain length: %s", err)
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, int(domainLength[0])+2)); err != nil {
+		t.Errorf("read domain/port: %s", err)
+		return
+	}
+
+	reply := []byte{socksVersion5, socksReplySucceeded, 0x00, socksAddressTypeIPv4}
+	reply = append(reply, 0, 0, 0, 0, 0, 0)
+	conn.Write(reply)
+}
+
+func TestSocksConnectNoAuth(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go serveSOCKSConnect(t, serverConn, false)
+
+	if err := socksConnect(clientConn, "example.com:443", "", ""); err != nil {
+		t.Fatalf("socksConnect failed: %s", err)
+	}
+}
+
+func TestSocksConnectWithAuth(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go serveSOCKSConnect(t, serverConn, true)
+
+	if err := socksConnect(clientConn, "example.com:443", "user", "pass"); err != nil {
+		t.Fatalf("socksConnect failed: %s", err)
+	}
+}
+
+func TestSocksConnectRejectedAuthMethod(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		greeting := make([]byte, 2)
+		io.ReadFull(serverConn, greeting)
+		io.ReadFull(serverConn, make([]byte, greeting[1]))
+		serverConn.Write([]byte{socksVersion5, socksAuthMethodNoAcceptableMethod})
+	}()
+
+	if err := socksConnect(clientConn, "example.com:443", "", ""); err == nil {
+		t.Fatal("expected error for rejected authentication method")
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// NewTCPDialer creates a Dialer that establishes a direct TCP connection,
+// optionally through an upstream HTTP or SOCKS5 proxy, and optionally
+// bound to a device (to exclude the connection from VPN routing) via
+// dialConfig.BindToDeviceProvider. dialConfig.PendingConns is used to
+// allow interrupting the dial in progress.
+func NewTCPDialer(dialConfig *DialConfig) Dialer {
+	return func(network, addr string) (net.Conn, error) {
+		return tcpDial(network, addr, dialConfig)
+	}
+}
+
+func tcpDial(network, addr string, dialConfig *DialConfig) (conn net.Conn, err error) {
+
+	dialAddr := addr
+	if dialConfig.SecureResolver != nil && dialConfig.UpstreamSocksProxyAddress == "" &&
+		dialConfig.UpstreamHttpProxyAddress == "" {
+		// Resolve via the secure resolver only when dialing the target
+		// directly; an upstream proxy resolves the target itself.
+		dialAddr, err = resolveDialAddress(addr, dialConfig)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+	if dialConfig.UpstreamSocksProxyAddress != "" {
+		dialAddr = dialConfig.UpstreamSocksProxyAddress
+	} else if dialConfig.UpstreamHttpProxyAddress != "" {
+		dialAddr = dialConfig.UpstreamHttpProxyAddress
+	}
+
+	rawConn, err := dialRawConn(network, dialAddr, dialConfig)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if dialConfig.PendingConns != nil {
+		defer dialConfig.PendingConns.Remove(rawConn)
+	}
+
+	if dialConfig.UpstreamSocksProxyAddress != "" {
+		err = socksConnect(
+			rawConn, addr, dialConfig.UpstreamProxyUsername, dialConfig.UpstreamProxyPassword)
+		if err != nil {
+			rawConn.Close()
+			return nil, ContextError(err)
+		}
+	} else if dialConfig.UpstreamHttpProxyAddress != "" {
+		var auth ProxyAuthorization
+		if dialConfig.UpstreamProxyUsername != "" || dialConfig.UpstreamProxyPassword != "" {
+			auth = &basicProxyAuthorization{
+				username: dialConfig.UpstreamProxyUsername,
+				password: dialConfig.UpstreamProxyPassword,
+			}
+		}
+		err = HttpProxyConnect(rawConn, addr, auth)
+		if err != nil {
+			rawConn.Close()
+			return nil, ContextError(err)
+		}
+	}
+
+	return rawConn, nil
+}
+
+// resolveDialAddress resolves the hostname component of addr using
+// dialConfig.SecureResolver, returning addr unchanged if it is already an
+// IP address.
+func resolveDialAddress(addr string, dialConfig *DialConfig) (string, error) {
+	hostname, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	if net.ParseIP(hostname) != nil {
+		return addr, nil
+	}
+	ipAddress, err := ResolveIPAddress(hostname, dialConfig, dialConfig.SecureResolver)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	return net.JoinHostPort(ipAddress, port), nil
+}
+
+// dialRawConn establishes the underlying network connection to dialAddr,
+// registering it with dialConfig.PendingConns so the dial may be
+// interrupted, and submitting it to dialConfig.BindToDeviceProvider, if
+// set, before connecting.
+func dialRawConn(network, dialAddr string, dialConfig *DialConfig) (conn net.Conn, err error) {
+
+	dialer := &net.Dialer{
+		Timeout: dialConfig.ConnectTimeout,
+	}
+
+	if dialConfig.BindToDeviceProvider != nil {
+		dialer.Control = func(_, _ string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				dialConfig.BindToDeviceProvider.BindToDevice(int(fd))
+			})
+		}
+	}
+
+	conn, err = dialer.Dial(network, dialAddr)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if dialConfig.PendingConns != nil {
+		if !dialConfig.PendingConns.Add(conn) {
+			conn.Close()
+			return nil, ContextError(errors.New("pending conns already closed"))
+		}
+	}
+
+	return conn, nil
+}
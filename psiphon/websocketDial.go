@@ -0,0 +1,393 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocketConfig configures a WebSocket handshake: the Origin header and
+// any application subprotocols to offer, both chosen to make the
+// handshake blend in with ordinary web traffic.
+type WebSocketConfig struct {
+	Origin       string
+	Subprotocols []string
+}
+
+// NewWebSocketDialer creates a Dialer, compatible with http.Transport.Dial
+// and the tunnel relay, that performs an HTTP/1.1 Upgrade handshake
+// (RFC 6455) to wsURL -- through dialConfig.UpstreamHttpProxyAddress via
+// HttpProxyConnect, when set -- and returns a net.Conn that frames writes
+// as masked binary WebSocket frames and reassembles reads from incoming
+// frames. tlsConfig, when wsURL is wss://, is applied after the proxy
+// CONNECT and before the Upgrade request, so SNI can be set independently
+// of wsURL's host.
+func NewWebSocketDialer(dialConfig *DialConfig, wsURL string, tlsConfig *tls.Config, wsConfig *WebSocketConfig) Dialer {
+	return func(network, addr string) (net.Conn, error) {
+		return webSocketDial(dialConfig, wsURL, tlsConfig, wsConfig)
+	}
+}
+
+func webSocketDial(
+	dialConfig *DialConfig, wsURL string, tlsConfig *tls.Config, wsConfig *WebSocketConfig) (net.Conn, error) {
+
+	parsedURL, err := url.Parse(wsURL)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	isTLS := parsedURL.Scheme == "wss"
+	addr := parsedURL.Host
+	if !strings.Contains(addr, ":") {
+		if isTLS {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+
+	dialAddr := addr
+	if dialConfig.UpstreamHttpProxyAddress != "" {
+		dialAddr = dialConfig.UpstreamHttpProxyAddress
+	}
+
+	rawConn, err := dialRawConn("tcp", dialAddr, dialConfig)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if dialConfig.PendingConns != nil {
+		defer dialConfig.PendingConns.Remove(rawConn)
+	}
+
+	if dialConfig.UpstreamHttpProxyAddress != "" {
+		var auth ProxyAuthorization
+		if dialConfig.UpstreamProxyUsername != "" || dialConfig.UpstreamProxyPassword != "" {
+			auth = &basicProxyAuthorization{
+				username: dialConfig.UpstreamProxyUsername,
+				password: dialConfig.UpstreamProxyPassword,
+			}
+		}
+		err = HttpProxyConnect(rawConn, addr, auth)
+		if err != nil {
+			rawConn.Close()
+			return nil, ContextError(err)
+		}
+	}
+
+	var conn net.Conn = rawConn
+	if isTLS {
+		clientTLSConfig := tlsConfig
+		if clientTLSConfig == nil {
+			clientTLSConfig = &tls.Config{}
+		}
+		tlsConn := tls.Client(rawConn, clientTLSConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			rawConn.Close()
+			return nil, ContextError(err)
+		}
+		conn = tlsConn
+	}
+
+	reader, err := webSocketDialUpgrade(conn, parsedURL, wsConfig)
+	if err != nil {
+		conn.Close()
+		return nil, ContextError(err)
+	}
+
+	return newWebSocketConn(conn, reader), nil
+}
+
+// webSocketDialUpgrade sends the HTTP/1.1 Upgrade request and validates
+// the server's handshake response, per RFC 6455 section 1.3. It returns
+// the buffered reader used to read the handshake response, which the
+// caller must reuse for subsequent frame reads: the server is free to
+// pipeline WebSocket frames immediately after the 101 response, and a
+// fresh bufio.Reader over conn would silently drop any bytes already
+// buffered by this one.
+func webSocketDialUpgrade(conn net.Conn, parsedURL *url.URL, wsConfig *WebSocketConfig) (*bufio.Reader, error) {
+
+	keyBytes := make([]byte, 16)
+	_, err := rand.Read(keyBytes)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	requestPath := parsedURL.RequestURI()
+
+	request := &bytes.Buffer{}
+	fmt.Fprintf(request, "GET %s HTTP/1.1\r\n", requestPath)
+	fmt.Fprintf(request, "Host: %s\r\n", parsedURL.Host)
+	fmt.Fprintf(request, "Upgrade: websocket\r\n")
+	fmt.Fprintf(request, "Connection: Upgrade\r\n")
+	fmt.Fprintf(request, "Sec-WebSocket-Key: %s\r\n", key)
+	fmt.Fprintf(request, "Sec-WebSocket-Version: 13\r\n")
+	if wsConfig != nil {
+		if wsConfig.Origin != "" {
+			fmt.Fprintf(request, "Origin: %s\r\n", wsConfig.Origin)
+		}
+		if len(wsConfig.Subprotocols) > 0 {
+			fmt.Fprintf(request, "Sec-WebSocket-Protocol: %s\r\n", strings.Join(wsConfig.Subprotocols, ", "))
+		}
+	}
+	fmt.Fprintf(request, "\r\n")
+
+	_, err = conn.Write(request.Bytes())
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, ContextError(fmt.Errorf("unexpected WebSocket upgrade status: %d", response.StatusCode))
+	}
+	if !strings.EqualFold(response.Header.Get("Upgrade"), "websocket") {
+		return nil, ContextError(errors.New("missing Upgrade: websocket header"))
+	}
+
+	expectedAccept := computeWebSocketAccept(key)
+	if response.Header.Get("Sec-WebSocket-Accept") != expectedAccept {
+		return nil, ContextError(errors.New("invalid Sec-WebSocket-Accept"))
+	}
+
+	return reader, nil
+}
+
+func computeWebSocketAccept(key string) string {
+	hash := sha1.New()
+	hash.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// WebSocket opcodes (RFC 6455 section 5.2).
+const (
+	webSocketOpContinuation = 0x0
+	webSocketOpText         = 0x1
+	webSocketOpBinary       = 0x2
+	webSocketOpClose        = 0x8
+	webSocketOpPing         = 0x9
+	webSocketOpPong         = 0xa
+)
+
+// webSocketConn wraps an established WebSocket connection as a net.Conn:
+// Write frames payloads as masked binary frames (RFC 6455 requires the
+// client to mask every frame); Read reassembles payloads from incoming
+// frames, replying to pings with pongs and surfacing a close frame as
+// io.EOF.
+type webSocketConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+	pending    []byte
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader) *webSocketConn {
+	return &webSocketConn{
+		Conn:   conn,
+		reader: reader,
+	}
+}
+
+const maxWebSocketFramePayload = 1 << 20
+
+func (conn *webSocketConn) Write(b []byte) (int, error) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	written := 0
+	for written < len(b) {
+		end := written + maxWebSocketFramePayload
+		if end > len(b) {
+			end = len(b)
+		}
+		err := conn.writeFrame(webSocketOpBinary, b[written:end])
+		if err != nil {
+			return written, ContextError(err)
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// writeFrame writes a single masked WebSocket frame (RFC 6455 section
+// 5.2), masking the payload with a random 32-bit key as required for
+// client-to-server frames.
+func (conn *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode} // FIN=1, opcode
+
+	maskBit := byte(0x80)
+	length := len(payload)
+	switch {
+	case length <= 125:
+		header = append(header, maskBit|byte(length))
+	case length <= 0xffff:
+		header = append(header, maskBit|126, byte(length>>8), byte(length))
+	default:
+		header = append(header, maskBit|127,
+			0, 0, 0, 0,
+			byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	}
+
+	maskKey := make([]byte, 4)
+	_, err := rand.Read(maskKey)
+	if err != nil {
+		return ContextError(err)
+	}
+	header = append(header, maskKey...)
+
+	masked := make([]byte, length)
+	for i := 0; i < length; i++ {
+		masked[i] = payload[i] ^ maskKey[i%4]
+	}
+
+	_, err = conn.Conn.Write(header)
+	if err != nil {
+		return ContextError(err)
+	}
+	_, err = conn.Conn.Write(masked)
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+func (conn *webSocketConn) Read(b []byte) (int, error) {
+	for len(conn.pending) == 0 {
+		opcode, payload, err := conn.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case webSocketOpPing:
+			err = conn.writeFrame(webSocketOpPong, payload)
+			if err != nil {
+				return 0, ContextError(err)
+			}
+		case webSocketOpClose:
+			return 0, io.EOF
+		case webSocketOpBinary, webSocketOpText, webSocketOpContinuation:
+			conn.pending = payload
+		}
+	}
+	n := copy(b, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
+
+// readFrame reads a single WebSocket frame from the server. RFC 6455
+// section 5.1 forbids servers from masking frames, but a masked frame is
+// not rejected here: its payload is unmasked and returned.
+func (conn *webSocketConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn.reader, header)
+	if err != nil {
+		return 0, nil, ContextError(err)
+	}
+
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(conn.reader, extended)
+		if err != nil {
+			return 0, nil, ContextError(err)
+		}
+		length = int64(extended[0])<<8 | int64(extended[1])
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(conn.reader, extended)
+		if err != nil {
+			return 0, nil, ContextError(err)
+		}
+		length = 0
+		for _, b := range extended {
+			length = length<<8 | int64(b)
+		}
+	}
+
+	// A 64-bit length with the high bit set decodes to a negative int64,
+	// which would otherwise pass the max-size check below and then panic
+	// in make([]byte, length).
+	if length < 0 || length > maxWebSocketFramePayload {
+		return 0, nil, ContextError(fmt.Errorf("oversized WebSocket frame: %d bytes", length))
+	}
+
+	var maskKey []byte
+	if masked {
+		maskKey = make([]byte, 4)
+		_, err = io.ReadFull(conn.reader, maskKey)
+		if err != nil {
+			return 0, nil, ContextError(err)
+		}
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(conn.reader, payload)
+	if err != nil {
+		return 0, nil, ContextError(err)
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+
+	return opcode, payload, nil
+}
+
+func (conn *webSocketConn) Close() error {
+	_ = conn.writeFrame(webSocketOpClose, nil)
+	return conn.Conn.Close()
+}
+
+func (conn *webSocketConn) SetDeadline(t time.Time) error {
+	return conn.Conn.SetDeadline(t)
+}
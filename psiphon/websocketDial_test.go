@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeNetConn adapts a bytes.Reader/Writer pair as the minimal net.Conn
+// readFrame needs: a bufio.Reader is layered on top in the tests, as in
+// the real webSocketConn.
+type fakeNetConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c *fakeNetConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func newTestWebSocketConn(frame []byte) *webSocketConn {
+	fake := &fakeNetConn{r: bytes.NewReader(frame)}
+	return &webSocketConn{
+		Conn:   fake,
+		reader: bufio.NewReader(fake),
+	}
+}
+
+func TestWebSocketReadFrameSmallPayload(t *testing.T) {
+	payload := []byte("hello")
+	frame := []byte{0x82, byte(len(payload))} // FIN=1, opcode=binary, unmasked
+	frame = append(frame, payload...)
+
+	conn := newTestWebSocketConn(frame)
+	opcode, got, err := conn.readFrame()
+	if err != nil {
+		t.Fatalf("readFrame failed: %s", err)
+	}
+	if opcode != webSocketOpBinary {
+		t.Fatalf("expected binary opcode, got %d", opcode)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("expected payload %q, got %q", payload, got)
+	}
+}
+
+func TestWebSocketReadFrameMasked(t *testing.T) {
+	payload := []byte("hello")
+	maskKey := []byte{0x11, 0x22, 0x33, 0x44}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ maskKey[i%4]
+	}
+
+	frame := []byte{0x82, 0x80 | byte(len(payload))}
+	frame = append(frame, maskKey...)
+	frame = append(frame, masked...)
+
+	conn := newTestWebSocketConn(frame)
+	_, got, err := conn.readFrame()
+	if err != nil {
+		t.Fatalf("readFrame failed: %s", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("expected unmasked payload %q, got %q", payload, got)
+	}
+}
+
+func TestWebSocketReadFrameRejectsOversizedLength(t *testing.T) {
+	frame := []byte{0x82, 127}
+	frame = append(frame, 0, 0, 0, 0, 0x00, 0x20, 0x00, 0x00) // > maxWebSocketFramePayload
+
+	conn := newTestWebSocketConn(frame)
+	if _, _, err := conn.readFrame(); err == nil {
+		t.Fatal("expected error for oversized frame length")
+	}
+}
+
+func TestWebSocketReadFrameRejectsNegativeLength(t *testing.T) {
+	frame := []byte{0x82, 127}
+	frame = append(frame, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff) // MSB set
+
+	conn := newTestWebSocketConn(frame)
+	if _, _, err := conn.readFrame(); err == nil {
+		t.Fatal("expected error for a length that decodes negative, not a panic")
+	}
+}
+
+func TestWebSocketDialUpgradeRejectsNon101Response(t *testing.T) {
+	// The server answers the Upgrade request with 400 Bad Request, which
+	// webSocketDialUpgrade must reject with an error. Reuse of the
+	// handshake's buffered reader for frame reads is not checked here.
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		request := make([]byte, 4096)
+		_, _ = serverConn.Read(request)
+		serverConn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"))
+	}()
+
+	parsedURL, err := url.Parse("ws://example.com/chat")
+	if err != nil {
+		t.Fatalf("url.Parse failed: %s", err)
+	}
+
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := webSocketDialUpgrade(clientConn, parsedURL, nil); err == nil {
+		t.Fatal("expected webSocketDialUpgrade to fail on a non-101 response")
+	}
+}